@@ -0,0 +1,57 @@
+// Copyright 2018 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appservice
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/storage/postgres"
+	"github.com/matrix-org/dendrite/appservice/storage/sqlite3"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NewDatabase opens a database connection for the appservice component,
+// choosing the Postgres or SQLite backend based on the scheme of
+// dataSourceName (see common.OpenWithObservability), and preparing its
+// schema and statements. Query latency, errors and in-flight counts are
+// registered against registerer so that slow application service scans
+// become observable without a tracer backend.
+//
+// This lives alongside Worker rather than in the storage package itself so
+// that the Postgres and SQLite implementations can depend on storage's
+// shared types (such as EphemeralEvent) without an import cycle.
+func NewDatabase(tracerFactory common.NewTracerFactory, registerer prometheus.Registerer, dataSourceName string) (storage.Database, error) {
+	db, driver, err := common.OpenWithObservability(tracerFactory, registerer, "appservice", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	switch driver {
+	case common.DriverPostgres:
+		return postgres.NewDatabase(db)
+	case common.DriverSQLite:
+		// A worker's CompleteTransaction can race an InsertEvent from the
+		// producer side; go-sqlite3 has no built-in retry on SQLITE_BUSY, so
+		// concurrent writers are serialised here to turn a lock conflict
+		// into a wait (backed by the busy timeout common.OpenWithObservability
+		// already set) rather than a "database is locked" error.
+		db.SetMaxOpenConns(1)
+		return sqlite3.NewDatabase(db)
+	default:
+		return nil, fmt.Errorf("appservice: unknown driver %q", driver)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+//go:generate mockgen -source=interface.go -destination=mock/mock_database.go -package=mock
+
+import (
+	"context"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Database is the interface that an appservice event store must implement,
+// regardless of which SQL driver backs it.
+type Database interface {
+	// SelectEventsByApplicationServiceID returns the transaction currently in
+	// flight for the given application service: its txn_id, up to limit room
+	// events, and the retry bookkeeping needed to honour exponential backoff
+	// across restarts. The returned Batch has no EventIDs if nothing is
+	// queued.
+	SelectEventsByApplicationServiceID(ctx context.Context, appServiceID string, limit int) (Batch, error)
+	// SelectEphemeralEventsByApplicationServiceID returns the ephemeral EDUs
+	// (MSC2409) queued as part of the given transaction, excluding any that
+	// have passed their per-AS TTL, along with the highest internal id
+	// among them. Like Batch.MaxEventID, that id is the bound
+	// CompleteTransaction must delete up to, so an EDU inserted after this
+	// call (e.g. while the transaction is in flight to the AS) isn't
+	// silently discarded unsent.
+	SelectEphemeralEventsByApplicationServiceID(ctx context.Context, appServiceID string, txnID int64) (events []EphemeralEvent, maxID int64, err error)
+	// InsertEvent queues an event for delivery to the given application
+	// service, folding it into whichever transaction is currently in flight
+	// (or opening a new one, assigning it a txn_id from a per-AS sequence, if
+	// none is).
+	InsertEvent(ctx context.Context, appServiceID string, event gomatrixserverlib.Event) error
+	// InsertEphemeralEvent queues an ephemeral EDU for delivery to the given
+	// application service, which must have opted in via
+	// de.sorunome.msc2409.receive_ephemeral.
+	InsertEphemeralEvent(ctx context.Context, appServiceID string, ephEvent EphemeralEvent) error
+	// MarkTransactionFailed records a failed delivery attempt of txnID,
+	// persisting nextRetryAt so a restarted worker honours the same backoff
+	// rather than retrying immediately. It returns the attempt count so far,
+	// so the caller can decide whether to report the transaction as stuck.
+	MarkTransactionFailed(ctx context.Context, appServiceID string, txnID int64, nextRetryAt int64) (attemptCount int, err error)
+	// CompleteTransaction atomically removes an acknowledged transaction's
+	// room events (up to and including maxEventID), its ephemeral EDUs (up
+	// to and including maxEphemeralID) and its retry bookkeeping.
+	CompleteTransaction(ctx context.Context, appServiceID string, txnID int64, maxEventID int64, maxEphemeralID int64) error
+	// DeleteExpiredEphemeralEvents removes every ephemeral EDU queued for the
+	// given application service that has passed its TTL, regardless of which
+	// transaction it's batched into. Callers should invoke this periodically
+	// (e.g. on each failed delivery attempt) so ephemeral rows tied to a
+	// transaction that never completes don't accumulate until the next
+	// restart, which only runs the equivalent sweep once at boot.
+	DeleteExpiredEphemeralEvents(ctx context.Context, appServiceID string) error
+}
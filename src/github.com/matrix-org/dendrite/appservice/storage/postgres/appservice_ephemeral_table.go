@@ -0,0 +1,169 @@
+// Copyright 2020 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// defaultEphemeralTTL is how long an ephemeral EDU (typing, presence, read
+// receipt) is kept around waiting for delivery before it is considered
+// stale. Synapse applies a similar bound: ephemeral state is only useful to
+// an application service while it's still current.
+const defaultEphemeralTTL = 5 * 60
+
+// appserviceEphemeralSchema stores MSC2409 ephemeral EDUs separately from
+// room events, since they have no event_id and must be dropped once stale
+// rather than retried indefinitely.
+const appserviceEphemeralSchema = `
+CREATE TABLE IF NOT EXISTS appservice_ephemeral (
+	id BIGSERIAL NOT NULL PRIMARY KEY,
+	as_id TEXT NOT NULL,
+	edu_type TEXT NOT NULL,
+	room_id TEXT NOT NULL DEFAULT '',
+	edu_content TEXT,
+	-- The ID of the transaction this EDU is batched into for delivery
+	txn_id BIGINT NOT NULL,
+	-- Unix seconds after which this EDU is considered stale and is
+	-- dropped rather than delivered
+	expires_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS appservice_ephemeral_as_id ON appservice_ephemeral(as_id);
+
+-- Drop anything that went stale while Dendrite wasn't running.
+DELETE FROM appservice_ephemeral WHERE expires_at <= extract(epoch from now());
+`
+
+const insertEphemeralEventSQL = "" +
+	"INSERT INTO appservice_ephemeral(as_id, edu_type, room_id, edu_content, txn_id, expires_at) " +
+	"VALUES ($1, $2, $3, $4, $5, $6)"
+
+const selectEphemeralEventsByTxnIDSQL = "" +
+	"SELECT id, edu_type, room_id, edu_content FROM appservice_ephemeral " +
+	"WHERE as_id = $1 AND txn_id = $2 AND expires_at > extract(epoch from now()) ORDER BY id ASC"
+
+const deleteEphemeralEventsByTxnIDSQL = "" +
+	"DELETE FROM appservice_ephemeral WHERE as_id = $1 AND txn_id = $2 AND id <= $3"
+
+const deleteExpiredEphemeralEventsSQL = "" +
+	"DELETE FROM appservice_ephemeral WHERE as_id = $1 AND expires_at <= extract(epoch from now())"
+
+type ephemeralStatements struct {
+	insertEphemeralEventStmt         *sql.Stmt
+	selectEphemeralEventsByTxnIDStmt *sql.Stmt
+	deleteEphemeralEventsByTxnIDStmt *sql.Stmt
+	deleteExpiredEphemeralEventsStmt *sql.Stmt
+}
+
+func (s *ephemeralStatements) prepare(db *sql.DB) (err error) {
+	if _, err = db.Exec(appserviceEphemeralSchema); err != nil {
+		return
+	}
+	if s.insertEphemeralEventStmt, err = db.Prepare(insertEphemeralEventSQL); err != nil {
+		return
+	}
+	if s.selectEphemeralEventsByTxnIDStmt, err = db.Prepare(selectEphemeralEventsByTxnIDSQL); err != nil {
+		return
+	}
+	if s.deleteEphemeralEventsByTxnIDStmt, err = db.Prepare(deleteEphemeralEventsByTxnIDSQL); err != nil {
+		return
+	}
+	if s.deleteExpiredEphemeralEventsStmt, err = db.Prepare(deleteExpiredEphemeralEventsSQL); err != nil {
+		return
+	}
+	return
+}
+
+// insertEphemeralEvent queues an ephemeral EDU for the given application
+// service under txnID, to expire at expiresAt (unix seconds) if never
+// delivered.
+func (s *ephemeralStatements) insertEphemeralEvent(
+	ctx context.Context,
+	txn *sql.Tx,
+	appServiceID string,
+	ephEvent storage.EphemeralEvent,
+	expiresAt int64,
+	txnID int64,
+) (err error) {
+	_, err = common.TxStmt(txn, s.insertEphemeralEventStmt).ExecContext(
+		ctx, appServiceID, ephEvent.Type, ephEvent.RoomID, ephEvent.Content, txnID, expiresAt,
+	)
+	return
+}
+
+// selectEphemeralEventsByTxnID returns the ephemeral EDUs batched into the
+// given transaction, excluding any that have passed their TTL, along with
+// the highest internal id among the rows actually returned. Callers must use
+// that bounded maxID (not the transaction's unbounded running total) as the
+// deletion boundary once the page is acknowledged, since an EDU may have
+// been folded into the same transaction after this call ran.
+func (s *ephemeralStatements) selectEphemeralEventsByTxnID(
+	ctx context.Context,
+	txn *sql.Tx,
+	appServiceID string,
+	txnID int64,
+) (events []storage.EphemeralEvent, maxID int64, err error) {
+	rows, err := common.TxStmt(txn, s.selectEphemeralEventsByTxnIDStmt).QueryContext(ctx, appServiceID, txnID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	for rows.Next() {
+		var id int64
+		var event storage.EphemeralEvent
+		var content sql.NullString
+		if err = rows.Scan(&id, &event.Type, &event.RoomID, &content); err != nil {
+			return nil, 0, err
+		}
+		if content.Valid {
+			event.Content = gomatrixserverlib.RawJSON(content.String)
+		}
+		if id > maxID {
+			maxID = id
+		}
+		events = append(events, event)
+	}
+	return
+}
+
+// deleteEphemeralEventsByTxnID removes every ephemeral EDU up to and
+// including maxID belonging to the given transaction, once it has been
+// acknowledged by the application service. Bounding by maxID (rather than
+// deleting the whole (as_id, txn_id) bucket) avoids discarding an EDU that
+// was folded into the same in-flight transaction after it was selected for
+// delivery but before delivery was acknowledged.
+func (s *ephemeralStatements) deleteEphemeralEventsByTxnID(ctx context.Context, txn *sql.Tx, appServiceID string, txnID int64, maxID int64) error {
+	_, err := common.TxStmt(txn, s.deleteEphemeralEventsByTxnIDStmt).ExecContext(ctx, appServiceID, txnID, maxID)
+	return err
+}
+
+// deleteExpiredEphemeralEvents removes every ephemeral EDU queued for the
+// given application service that has passed its TTL, regardless of which
+// transaction it's batched into. This is the same condition the boot-time
+// sweep in appserviceEphemeralSchema applies once at startup; calling it
+// from the worker's retry path as well bounds table growth for a
+// transaction that's stuck retrying against a down application service for
+// longer than Dendrite's uptime.
+func (s *ephemeralStatements) deleteExpiredEphemeralEvents(ctx context.Context, appServiceID string) error {
+	_, err := s.deleteExpiredEphemeralEventsStmt.ExecContext(ctx, appServiceID)
+	return err
+}
@@ -12,13 +12,14 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package storage
+package postgres
 
 import (
 	"context"
 	"database/sql"
 	"time"
 
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -41,32 +42,32 @@ CREATE TABLE IF NOT EXISTS appservice_events (
 	sender TEXT NOT NULL,
 	-- The JSON representation of the event's content. Text to avoid db JSON parsing
 	event_content TEXT,
-	-- The ID of the transaction that this event is a part of
-	txn_id INTEGER NOT NULL
+	-- The ID of the transaction this event is batched into for delivery
+	txn_id BIGINT NOT NULL
 );
 
-CREATE INDEX IF NOT EXISTS appservice_events_as_id ON appservice_event(as_id);
+CREATE INDEX IF NOT EXISTS appservice_events_as_id ON appservice_events(as_id);
 `
 
-const selectEventsByApplicationServiceIDSQL = "" +
-	"SELECT event_id, origin_server_ts, room_id, type, sender, event_content FROM appservice_events " +
-	"WHERE as_id = $1 ORDER BY id ASC LIMIT $2"
-
-const countEventsByApplicationServiceIDSQL = "" +
-	"SELECT COUNT(event_id) FROM appservice_events WHERE as_id = $1"
+const selectEventsByTxnIDSQL = "" +
+	"SELECT id, event_id, origin_server_ts, room_id, type, sender, event_content FROM appservice_events " +
+	"WHERE as_id = $1 AND txn_id = $2 ORDER BY id ASC LIMIT $3"
 
 const insertEventSQL = "" +
 	"INSERT INTO appservice_events(as_id, event_id, origin_server_ts, room_id, type, sender, event_content, txn_id) " +
 	"VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
 
-const deleteEventsBeforeAndIncludingIDSQL = "" +
-	"DELETE FROM appservice_events WHERE event_id <= $1"
+const deleteEventsUpToIDSQL = "" +
+	"DELETE FROM appservice_events WHERE as_id = $1 AND id <= $2"
+
+const hasMoreEventsSQL = "" +
+	"SELECT EXISTS(SELECT 1 FROM appservice_events WHERE as_id = $1 AND txn_id = $2)"
 
 type eventsStatements struct {
-	selectEventsByApplicationServiceIDStmt *sql.Stmt
-	countEventsByApplicationServiceIDStmt  *sql.Stmt
-	insertEventStmt                        *sql.Stmt
-	deleteEventsBeforeAndIncludingIDStmt   *sql.Stmt
+	selectEventsByTxnIDStmt *sql.Stmt
+	insertEventStmt         *sql.Stmt
+	deleteEventsUpToIDStmt  *sql.Stmt
+	hasMoreEventsStmt       *sql.Stmt
 }
 
 func (s *eventsStatements) prepare(db *sql.DB) (err error) {
@@ -75,44 +76,53 @@ func (s *eventsStatements) prepare(db *sql.DB) (err error) {
 		return
 	}
 
-	if s.selectEventsByApplicationServiceIDStmt, err = db.Prepare(selectEventsByApplicationServiceIDSQL); err != nil {
+	if s.selectEventsByTxnIDStmt, err = db.Prepare(selectEventsByTxnIDSQL); err != nil {
 		return
 	}
-	if s.countEventsByApplicationServiceIDStmt, err = db.Prepare(countEventsByApplicationServiceIDSQL); err != nil {
+	if s.insertEventStmt, err = db.Prepare(insertEventSQL); err != nil {
 		return
 	}
-	if s.insertEventStmt, err = db.Prepare(insertEventSQL); err != nil {
+	if s.deleteEventsUpToIDStmt, err = db.Prepare(deleteEventsUpToIDSQL); err != nil {
 		return
 	}
-	if s.deleteEventsBeforeAndIncludingIDStmt, err = db.Prepare(deleteEventsBeforeAndIncludingIDSQL); err != nil {
+	if s.hasMoreEventsStmt, err = db.Prepare(hasMoreEventsSQL); err != nil {
 		return
 	}
 
 	return
 }
 
-// selectEventsByApplicationServiceID takes in an application service ID and
-// returns a slice of events that need to be sent to that application service.
-func (s *eventsStatements) selectEventsByApplicationServiceID(
+// selectEventsByTxnID returns the room events batched into the given
+// transaction for the given application service, up to limit, along with
+// the highest internal id among the rows actually returned. Callers must
+// use that bounded maxEventID (not the transaction's unbounded running
+// total) as the deletion boundary once the page is acknowledged, since
+// more events may have been queued into the same transaction than fit in
+// this page.
+func (s *eventsStatements) selectEventsByTxnID(
 	ctx context.Context,
-	applicationServiceID string,
+	txn *sql.Tx,
+	appServiceID string,
+	txnID int64,
 	limit int,
 ) (
 	eventIDs []string,
 	events []gomatrixserverlib.ApplicationServiceEvent,
+	maxEventID int64,
 	err error,
 ) {
-	eventRows, err := s.selectEventsByApplicationServiceIDStmt.QueryContext(ctx, applicationServiceID, limit)
+	eventRows, err := common.TxStmt(txn, s.selectEventsByTxnIDStmt).QueryContext(ctx, appServiceID, txnID, limit)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, 0, err
 	}
 	defer eventRows.Close() // nolint: errcheck
 
-	// Iterate through each row and store event contents
 	for eventRows.Next() {
+		var id int64
 		var event gomatrixserverlib.ApplicationServiceEvent
 		var eventContent sql.NullString
 		err = eventRows.Scan(
+			&id,
 			&event.EventID,
 			&event.OriginServerTimestamp,
 			&event.RoomID,
@@ -121,12 +131,15 @@ func (s *eventsStatements) selectEventsByApplicationServiceID(
 			&eventContent,
 		)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, 0, err
 		}
 		if eventContent.Valid {
 			event.Content = gomatrixserverlib.RawJSON(eventContent.String)
 		}
 		eventIDs = append(eventIDs, event.EventID)
+		if id > maxEventID {
+			maxEventID = id
+		}
 
 		// Get age of the event from original timestamp and current time
 		ageMilli := time.Now().UnixNano() / int64(time.Millisecond)
@@ -141,29 +154,16 @@ func (s *eventsStatements) selectEventsByApplicationServiceID(
 	return
 }
 
-// countEventsByApplicationServiceID inserts an event mapped to its corresponding application service
-// IDs into the db.
-func (s *eventsStatements) countEventsByApplicationServiceID(
-	ctx context.Context,
-	appServiceID string,
-) (int, error) {
-	var count int
-	err := s.countEventsByApplicationServiceIDStmt.QueryRowContext(ctx, appServiceID).Scan(&count)
-	if err != nil && err != sql.ErrNoRows {
-		return 0, err
-	}
-
-	return count, nil
-}
-
-// insertEvent inserts an event mapped to its corresponding application service
-// IDs into the db.
+// insertEvent queues an event for the given application service under
+// txnID.
 func (s *eventsStatements) insertEvent(
 	ctx context.Context,
+	txn *sql.Tx,
 	appServiceID string,
 	event gomatrixserverlib.Event,
-) (err error) {
-	_, err = s.insertEventStmt.ExecContext(
+	txnID int64,
+) error {
+	_, err := common.TxStmt(txn, s.insertEventStmt).ExecContext(
 		ctx,
 		appServiceID,
 		event.EventID(),
@@ -172,16 +172,33 @@ func (s *eventsStatements) insertEvent(
 		event.Type(),
 		event.Sender(),
 		event.Content(),
-		nil,
+		txnID,
 	)
-	return
+	return err
 }
 
-// deleteEventsBeforeAndIncludingID removes events matching given IDs from the database.
-func (s *eventsStatements) deleteEventsBeforeAndIncludingID(
+// deleteEventsUpToID removes every event up to and including maxEventID
+// (the internal, monotonic id, not the Matrix event_id) for the given
+// application service.
+func (s *eventsStatements) deleteEventsUpToID(
 	ctx context.Context,
-	eventID string,
+	txn *sql.Tx,
+	appServiceID string,
+	maxEventID int64,
 ) (err error) {
-	_, err = s.deleteEventsBeforeAndIncludingIDStmt.ExecContext(ctx, eventID)
+	_, err = common.TxStmt(txn, s.deleteEventsUpToIDStmt).ExecContext(ctx, appServiceID, maxEventID)
 	return err
 }
+
+// hasMoreEvents reports whether any event is still queued under txnID for
+// the given application service, e.g. because it didn't fit in the page
+// that was just delivered and acknowledged.
+func (s *eventsStatements) hasMoreEvents(
+	ctx context.Context,
+	txn *sql.Tx,
+	appServiceID string,
+	txnID int64,
+) (exists bool, err error) {
+	err = common.TxStmt(txn, s.hasMoreEventsStmt).QueryRowContext(ctx, appServiceID, txnID).Scan(&exists)
+	return
+}
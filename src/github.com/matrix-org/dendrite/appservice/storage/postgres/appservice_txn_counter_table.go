@@ -0,0 +1,57 @@
+// Copyright 2020 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+// appserviceTxnCounterSchema keeps the next unused txn_id per application
+// service, so transaction IDs keep incrementing across restarts instead of
+// being recomputed from MAX(txn_id) (which would collide once a batch is
+// deleted).
+const appserviceTxnCounterSchema = `
+CREATE TABLE IF NOT EXISTS appservice_txn_counters (
+	as_id TEXT NOT NULL PRIMARY KEY,
+	next_txn_id BIGINT NOT NULL DEFAULT 1
+);
+`
+
+const selectNextTxnIDSQL = "" +
+	"INSERT INTO appservice_txn_counters (as_id, next_txn_id) VALUES ($1, 2) " +
+	"ON CONFLICT (as_id) DO UPDATE SET next_txn_id = appservice_txn_counters.next_txn_id + 1 " +
+	"RETURNING next_txn_id - 1"
+
+type txnCounterStatements struct {
+	selectNextTxnIDStmt *sql.Stmt
+}
+
+func (s *txnCounterStatements) prepare(db *sql.DB) (err error) {
+	if _, err = db.Exec(appserviceTxnCounterSchema); err != nil {
+		return
+	}
+	s.selectNextTxnIDStmt, err = db.Prepare(selectNextTxnIDSQL)
+	return
+}
+
+// nextTxnID atomically allocates and returns the next txn_id for the given
+// application service.
+func (s *txnCounterStatements) nextTxnID(ctx context.Context, txn *sql.Tx, appServiceID string) (txnID int64, err error) {
+	err = common.TxStmt(txn, s.selectNextTxnIDStmt).QueryRowContext(ctx, appServiceID).Scan(&txnID)
+	return
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+// appserviceTxnsSchema tracks the single transaction currently in flight for
+// each application service: its txn_id and how many times delivery has
+// failed so far, so a worker that restarts mid-backoff waits out the
+// remainder of the delay instead of hammering the AS again. Which events
+// the transaction covers is derived from appservice_events itself, not
+// tracked here, since a delivered page can be smaller than everything
+// queued into the transaction.
+const appserviceTxnsSchema = `
+CREATE TABLE IF NOT EXISTS appservice_txns (
+	as_id TEXT NOT NULL PRIMARY KEY,
+	txn_id BIGINT NOT NULL,
+	attempt_count BIGINT NOT NULL DEFAULT 0,
+	next_retry_at BIGINT NOT NULL DEFAULT 0
+);
+`
+
+const selectTxnSQL = "" +
+	"SELECT txn_id, attempt_count, next_retry_at FROM appservice_txns WHERE as_id = $1"
+
+const insertTxnSQL = "" +
+	"INSERT INTO appservice_txns (as_id, txn_id, attempt_count, next_retry_at) VALUES ($1, $2, 0, 0)"
+
+const markTxnAttemptedSQL = "" +
+	"UPDATE appservice_txns SET attempt_count = attempt_count + 1, next_retry_at = $3 " +
+	"WHERE as_id = $1 AND txn_id = $2 RETURNING attempt_count"
+
+const resetTxnBackoffSQL = "" +
+	"UPDATE appservice_txns SET attempt_count = 0, next_retry_at = 0 WHERE as_id = $1 AND txn_id = $2"
+
+const deleteTxnSQL = "" +
+	"DELETE FROM appservice_txns WHERE as_id = $1 AND txn_id = $2"
+
+type txnsStatements struct {
+	selectTxnStmt        *sql.Stmt
+	insertTxnStmt        *sql.Stmt
+	markTxnAttemptedStmt *sql.Stmt
+	resetTxnBackoffStmt  *sql.Stmt
+	deleteTxnStmt        *sql.Stmt
+}
+
+func (s *txnsStatements) prepare(db *sql.DB) (err error) {
+	if _, err = db.Exec(appserviceTxnsSchema); err != nil {
+		return
+	}
+	if s.selectTxnStmt, err = db.Prepare(selectTxnSQL); err != nil {
+		return
+	}
+	if s.insertTxnStmt, err = db.Prepare(insertTxnSQL); err != nil {
+		return
+	}
+	if s.markTxnAttemptedStmt, err = db.Prepare(markTxnAttemptedSQL); err != nil {
+		return
+	}
+	if s.resetTxnBackoffStmt, err = db.Prepare(resetTxnBackoffSQL); err != nil {
+		return
+	}
+	s.deleteTxnStmt, err = db.Prepare(deleteTxnSQL)
+	return
+}
+
+// selectTxn returns the bookkeeping for the transaction currently in flight
+// for appServiceID, if any.
+func (s *txnsStatements) selectTxn(
+	ctx context.Context,
+	txn *sql.Tx,
+	appServiceID string,
+) (txnID, attemptCount, nextRetryAt int64, ok bool, err error) {
+	err = common.TxStmt(txn, s.selectTxnStmt).QueryRowContext(ctx, appServiceID).
+		Scan(&txnID, &attemptCount, &nextRetryAt)
+	if err == sql.ErrNoRows {
+		return 0, 0, 0, false, nil
+	}
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+	return txnID, attemptCount, nextRetryAt, true, nil
+}
+
+// insertTxn creates the bookkeeping row for a freshly allocated txnID.
+func (s *txnsStatements) insertTxn(ctx context.Context, txn *sql.Tx, appServiceID string, txnID int64) error {
+	_, err := common.TxStmt(txn, s.insertTxnStmt).ExecContext(ctx, appServiceID, txnID)
+	return err
+}
+
+// markAttempted records a failed delivery attempt of txnID, returning the
+// new attempt count so the caller can decide whether to report it as stuck.
+func (s *txnsStatements) markAttempted(
+	ctx context.Context,
+	txn *sql.Tx,
+	appServiceID string,
+	txnID, nextRetryAt int64,
+) (attemptCount int64, err error) {
+	err = common.TxStmt(txn, s.markTxnAttemptedStmt).QueryRowContext(ctx, appServiceID, txnID, nextRetryAt).Scan(&attemptCount)
+	return
+}
+
+// resetBackoff clears the retry backoff for txnID after a page of its
+// events is acknowledged but more remain queued under the same txn_id, so
+// the next page is fetched immediately rather than waiting out whatever
+// backoff the previous page accumulated.
+func (s *txnsStatements) resetBackoff(ctx context.Context, txn *sql.Tx, appServiceID string, txnID int64) error {
+	_, err := common.TxStmt(txn, s.resetTxnBackoffStmt).ExecContext(ctx, appServiceID, txnID)
+	return err
+}
+
+// deleteTxn removes the bookkeeping row for an acknowledged transaction.
+func (s *txnsStatements) deleteTxn(ctx context.Context, txn *sql.Tx, appServiceID string, txnID int64) error {
+	_, err := common.TxStmt(txn, s.deleteTxnStmt).ExecContext(ctx, appServiceID, txnID)
+	return err
+}
@@ -0,0 +1,206 @@
+// Copyright 2018 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// appserviceEventsSchema mirrors the Postgres schema but swaps BIGSERIAL for
+// SQLite's autoincrementing INTEGER PRIMARY KEY.
+const appserviceEventsSchema = `
+-- Stores events to be sent to application services
+CREATE TABLE IF NOT EXISTS appservice_events (
+	-- An auto-incrementing id unique to each event in the table
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	-- The ID of the application service the event will be sent to
+	as_id TEXT NOT NULL,
+	-- The ID of the event
+	event_id TEXT NOT NULL,
+	-- Unix seconds that the event was sent at from the originating server
+	origin_server_ts BIGINT NOT NULL,
+	-- The ID of the room that the event was sent in
+	room_id TEXT NOT NULL,
+	-- The type of the event (e.g. m.text)
+	type TEXT NOT NULL,
+	-- The ID of the user that sent the event
+	sender TEXT NOT NULL,
+	-- The JSON representation of the event's content. Text to avoid db JSON parsing
+	event_content TEXT,
+	-- The ID of the transaction this event is batched into for delivery
+	txn_id BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS appservice_events_as_id ON appservice_events(as_id);
+`
+
+const selectEventsByTxnIDSQL = "" +
+	"SELECT id, event_id, origin_server_ts, room_id, type, sender, event_content FROM appservice_events " +
+	"WHERE as_id = $1 AND txn_id = $2 ORDER BY id ASC LIMIT $3"
+
+const insertEventSQL = "" +
+	"INSERT INTO appservice_events(as_id, event_id, origin_server_ts, room_id, type, sender, event_content, txn_id) " +
+	"VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+
+const deleteEventsUpToIDSQL = "" +
+	"DELETE FROM appservice_events WHERE as_id = $1 AND id <= $2"
+
+const hasMoreEventsSQL = "" +
+	"SELECT EXISTS(SELECT 1 FROM appservice_events WHERE as_id = $1 AND txn_id = $2)"
+
+type eventsStatements struct {
+	selectEventsByTxnIDStmt *sql.Stmt
+	insertEventStmt         *sql.Stmt
+	deleteEventsUpToIDStmt  *sql.Stmt
+	hasMoreEventsStmt       *sql.Stmt
+}
+
+func (s *eventsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(appserviceEventsSchema)
+	if err != nil {
+		return
+	}
+
+	if s.selectEventsByTxnIDStmt, err = db.Prepare(selectEventsByTxnIDSQL); err != nil {
+		return
+	}
+	if s.insertEventStmt, err = db.Prepare(insertEventSQL); err != nil {
+		return
+	}
+	if s.deleteEventsUpToIDStmt, err = db.Prepare(deleteEventsUpToIDSQL); err != nil {
+		return
+	}
+	if s.hasMoreEventsStmt, err = db.Prepare(hasMoreEventsSQL); err != nil {
+		return
+	}
+
+	return
+}
+
+// selectEventsByTxnID returns the room events batched into the given
+// transaction for the given application service, up to limit, along with
+// the highest internal id among the rows actually returned. Callers must
+// use that bounded maxEventID (not the transaction's unbounded running
+// total) as the deletion boundary once the page is acknowledged, since
+// more events may have been queued into the same transaction than fit in
+// this page.
+func (s *eventsStatements) selectEventsByTxnID(
+	ctx context.Context,
+	txn *sql.Tx,
+	appServiceID string,
+	txnID int64,
+	limit int,
+) (
+	eventIDs []string,
+	events []gomatrixserverlib.ApplicationServiceEvent,
+	maxEventID int64,
+	err error,
+) {
+	eventRows, err := common.TxStmt(txn, s.selectEventsByTxnIDStmt).QueryContext(ctx, appServiceID, txnID, limit)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer eventRows.Close() // nolint: errcheck
+
+	for eventRows.Next() {
+		var id int64
+		var event gomatrixserverlib.ApplicationServiceEvent
+		var eventContent sql.NullString
+		err = eventRows.Scan(
+			&id,
+			&event.EventID,
+			&event.OriginServerTimestamp,
+			&event.RoomID,
+			&event.Type,
+			&event.UserID,
+			&eventContent,
+		)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if eventContent.Valid {
+			event.Content = gomatrixserverlib.RawJSON(eventContent.String)
+		}
+		eventIDs = append(eventIDs, event.EventID)
+		if id > maxEventID {
+			maxEventID = id
+		}
+
+		// Get age of the event from original timestamp and current time
+		ageMilli := time.Now().UnixNano() / int64(time.Millisecond)
+		event.Age = ageMilli - event.OriginServerTimestamp
+
+		// TODO: Synapse does this. Do app services really require this? :)
+		event.Sender = event.UserID
+
+		events = append(events, event)
+	}
+
+	return
+}
+
+// insertEvent queues an event for the given application service under
+// txnID.
+func (s *eventsStatements) insertEvent(
+	ctx context.Context,
+	txn *sql.Tx,
+	appServiceID string,
+	event gomatrixserverlib.Event,
+	txnID int64,
+) error {
+	_, err := common.TxStmt(txn, s.insertEventStmt).ExecContext(
+		ctx,
+		appServiceID,
+		event.EventID(),
+		event.OriginServerTS(),
+		event.RoomID(),
+		event.Type(),
+		event.Sender(),
+		event.Content(),
+		txnID,
+	)
+	return err
+}
+
+// deleteEventsUpToID removes every event up to and including maxEventID
+// (the internal, monotonic id, not the Matrix event_id) for the given
+// application service.
+func (s *eventsStatements) deleteEventsUpToID(
+	ctx context.Context,
+	txn *sql.Tx,
+	appServiceID string,
+	maxEventID int64,
+) (err error) {
+	_, err = common.TxStmt(txn, s.deleteEventsUpToIDStmt).ExecContext(ctx, appServiceID, maxEventID)
+	return err
+}
+
+// hasMoreEvents reports whether any event is still queued under txnID for
+// the given application service, e.g. because it didn't fit in the page
+// that was just delivered and acknowledged.
+func (s *eventsStatements) hasMoreEvents(
+	ctx context.Context,
+	txn *sql.Tx,
+	appServiceID string,
+	txnID int64,
+) (exists bool, err error) {
+	err = common.TxStmt(txn, s.hasMoreEventsStmt).QueryRowContext(ctx, appServiceID, txnID).Scan(&exists)
+	return
+}
@@ -0,0 +1,213 @@
+// Copyright 2018 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Database is a SQLite-backed implementation of the appservice event store.
+type Database struct {
+	db        *sql.DB
+	events    eventsStatements
+	ephemeral ephemeralStatements
+	counters  txnCounterStatements
+	txns      txnsStatements
+}
+
+// NewDatabase prepares the schema and statements needed to back the
+// appservice event store with an already-open SQLite connection.
+func NewDatabase(db *sql.DB) (*Database, error) {
+	events := eventsStatements{}
+	if err := events.prepare(db); err != nil {
+		return nil, err
+	}
+	ephemeral := ephemeralStatements{}
+	if err := ephemeral.prepare(db); err != nil {
+		return nil, err
+	}
+	counters := txnCounterStatements{}
+	if err := counters.prepare(db); err != nil {
+		return nil, err
+	}
+	txns := txnsStatements{}
+	if err := txns.prepare(db); err != nil {
+		return nil, err
+	}
+	return &Database{db, events, ephemeral, counters, txns}, nil
+}
+
+// openTransaction returns the txn_id currently in flight for appServiceID,
+// allocating a fresh one from the per-AS sequence and its bookkeeping row if
+// none is. Reusing an in-flight txn_id lets a worker that crashed
+// mid-delivery resume the same transaction after restart, as MSC2409
+// requires.
+func (d *Database) openTransaction(ctx context.Context, txn *sql.Tx, appServiceID string) (int64, error) {
+	txnID, _, _, ok, err := d.txns.selectTxn(ctx, txn, appServiceID)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		return txnID, nil
+	}
+
+	newTxnID, err := d.counters.nextTxnID(ctx, txn, appServiceID)
+	if err != nil {
+		return 0, err
+	}
+	if err = d.txns.insertTxn(ctx, txn, appServiceID, newTxnID); err != nil {
+		return 0, err
+	}
+	return newTxnID, nil
+}
+
+// SelectEventsByApplicationServiceID returns the transaction currently in
+// flight for the given application service, if any.
+func (d *Database) SelectEventsByApplicationServiceID(
+	ctx context.Context,
+	appServiceID string,
+	limit int,
+) (batch storage.Batch, err error) {
+	ctx = common.WithStatementLabel(ctx, "selectEventsByApplicationServiceID")
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		txnID, attemptCount, nextRetryAt, ok, terr := d.txns.selectTxn(ctx, txn, appServiceID)
+		if terr != nil || !ok {
+			return terr
+		}
+
+		eventIDs, events, maxEventID, terr := d.events.selectEventsByTxnID(ctx, txn, appServiceID, txnID, limit)
+		if terr != nil {
+			return terr
+		}
+
+		batch = storage.Batch{
+			TxnID:        txnID,
+			MaxEventID:   maxEventID,
+			EventIDs:     eventIDs,
+			Events:       events,
+			AttemptCount: int(attemptCount),
+			NextRetryAt:  nextRetryAt,
+		}
+		return nil
+	})
+	return
+}
+
+// SelectEphemeralEventsByApplicationServiceID returns the ephemeral EDUs
+// batched into the given transaction for the given application service.
+func (d *Database) SelectEphemeralEventsByApplicationServiceID(
+	ctx context.Context,
+	appServiceID string,
+	txnID int64,
+) ([]storage.EphemeralEvent, int64, error) {
+	ctx = common.WithStatementLabel(ctx, "selectEphemeralEventsByApplicationServiceID")
+	return d.ephemeral.selectEphemeralEventsByTxnID(ctx, nil, appServiceID, txnID)
+}
+
+// InsertEvent queues an event for delivery to the given application service,
+// folding it into whichever transaction is currently in flight (opening a
+// new one, from the per-AS sequence, if none is).
+func (d *Database) InsertEvent(
+	ctx context.Context,
+	appServiceID string,
+	event gomatrixserverlib.Event,
+) error {
+	ctx = common.WithStatementLabel(ctx, "insertEvent")
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		txnID, err := d.openTransaction(ctx, txn, appServiceID)
+		if err != nil {
+			return err
+		}
+		return d.events.insertEvent(ctx, txn, appServiceID, event, txnID)
+	})
+}
+
+// InsertEphemeralEvent queues an ephemeral EDU for delivery to the given
+// application service, to be dropped if undelivered after defaultEphemeralTTL.
+func (d *Database) InsertEphemeralEvent(
+	ctx context.Context,
+	appServiceID string,
+	ephEvent storage.EphemeralEvent,
+) error {
+	ctx = common.WithStatementLabel(ctx, "insertEphemeralEvent")
+	expiresAt := time.Now().Unix() + defaultEphemeralTTL
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		txnID, err := d.openTransaction(ctx, txn, appServiceID)
+		if err != nil {
+			return err
+		}
+		return d.ephemeral.insertEphemeralEvent(ctx, txn, appServiceID, ephEvent, expiresAt, txnID)
+	})
+}
+
+// MarkTransactionFailed records a failed delivery attempt of txnID.
+func (d *Database) MarkTransactionFailed(
+	ctx context.Context,
+	appServiceID string,
+	txnID int64,
+	nextRetryAt int64,
+) (int, error) {
+	ctx = common.WithStatementLabel(ctx, "markTransactionFailed")
+	attemptCount, err := d.txns.markAttempted(ctx, nil, appServiceID, txnID, nextRetryAt)
+	return int(attemptCount), err
+}
+
+// CompleteTransaction atomically removes an acknowledged transaction's
+// delivered room events (up to and including maxEventID) and delivered
+// ephemeral EDUs (up to and including maxEphemeralID). If the transaction
+// had more events queued than fit in the delivered page, its bookkeeping
+// row is kept (with its backoff cleared) so the remaining events are picked
+// up as the same txn_id on the next call, rather than being stranded under
+// a transaction whose row was deleted.
+func (d *Database) CompleteTransaction(
+	ctx context.Context,
+	appServiceID string,
+	txnID int64,
+	maxEventID int64,
+	maxEphemeralID int64,
+) error {
+	ctx = common.WithStatementLabel(ctx, "completeTransaction")
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.events.deleteEventsUpToID(ctx, txn, appServiceID, maxEventID); err != nil {
+			return err
+		}
+		if err := d.ephemeral.deleteEphemeralEventsByTxnID(ctx, txn, appServiceID, txnID, maxEphemeralID); err != nil {
+			return err
+		}
+
+		moreEvents, err := d.events.hasMoreEvents(ctx, txn, appServiceID, txnID)
+		if err != nil {
+			return err
+		}
+		if moreEvents {
+			return d.txns.resetBackoff(ctx, txn, appServiceID, txnID)
+		}
+		return d.txns.deleteTxn(ctx, txn, appServiceID, txnID)
+	})
+}
+
+// DeleteExpiredEphemeralEvents removes every ephemeral EDU queued for the
+// given application service that has passed its TTL, regardless of which
+// transaction it's batched into.
+func (d *Database) DeleteExpiredEphemeralEvents(ctx context.Context, appServiceID string) error {
+	ctx = common.WithStatementLabel(ctx, "deleteExpiredEphemeralEvents")
+	return d.ephemeral.deleteExpiredEphemeralEvents(ctx, appServiceID)
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/storage"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+	rawDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open in-memory database: %v", err)
+	}
+	t.Cleanup(func() { rawDB.Close() }) // nolint: errcheck
+
+	d, err := NewDatabase(rawDB)
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	return d
+}
+
+func TestTxnIDSequenceIsPerApplicationServiceAndReused(t *testing.T) {
+	d := newTestDatabase(t)
+	ctx := context.Background()
+
+	if err := d.InsertEphemeralEvent(ctx, "as1", storage.EphemeralEvent{Type: "m.typing"}); err != nil {
+		t.Fatalf("InsertEphemeralEvent: %v", err)
+	}
+	if err := d.InsertEphemeralEvent(ctx, "as2", storage.EphemeralEvent{Type: "m.typing"}); err != nil {
+		t.Fatalf("InsertEphemeralEvent: %v", err)
+	}
+	// A second EDU for as1 should fold into the transaction already in
+	// flight for as1, not allocate a fresh txn_id from the per-AS sequence.
+	if err := d.InsertEphemeralEvent(ctx, "as1", storage.EphemeralEvent{Type: "m.presence"}); err != nil {
+		t.Fatalf("InsertEphemeralEvent: %v", err)
+	}
+
+	as1Batch, err := d.SelectEventsByApplicationServiceID(ctx, "as1", 0)
+	if err != nil {
+		t.Fatalf("SelectEventsByApplicationServiceID(as1): %v", err)
+	}
+	as2Batch, err := d.SelectEventsByApplicationServiceID(ctx, "as2", 0)
+	if err != nil {
+		t.Fatalf("SelectEventsByApplicationServiceID(as2): %v", err)
+	}
+	if as1Batch.TxnID != 1 || as2Batch.TxnID != 1 {
+		t.Fatalf("expected each application service to start its own txn_id sequence at 1, got as1=%d as2=%d", as1Batch.TxnID, as2Batch.TxnID)
+	}
+
+	as1Events, _, err := d.SelectEphemeralEventsByApplicationServiceID(ctx, "as1", as1Batch.TxnID)
+	if err != nil {
+		t.Fatalf("SelectEphemeralEventsByApplicationServiceID(as1): %v", err)
+	}
+	if len(as1Events) != 2 {
+		t.Fatalf("expected both as1 EDUs to share txn_id %d, got %d events", as1Batch.TxnID, len(as1Events))
+	}
+}
+
+func TestExpiredEphemeralEventsAreExcludedAndSwept(t *testing.T) {
+	d := newTestDatabase(t)
+	ctx := context.Background()
+
+	if err := d.txns.insertTxn(ctx, nil, "as1", 1); err != nil {
+		t.Fatalf("insertTxn: %v", err)
+	}
+	expired := storage.EphemeralEvent{Type: "m.typing"}
+	if err := d.ephemeral.insertEphemeralEvent(ctx, nil, "as1", expired, time.Now().Unix()-1, 1); err != nil {
+		t.Fatalf("insertEphemeralEvent: %v", err)
+	}
+
+	events, _, err := d.SelectEphemeralEventsByApplicationServiceID(ctx, "as1", 1)
+	if err != nil {
+		t.Fatalf("SelectEphemeralEventsByApplicationServiceID: %v", err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("expected the expired EDU to be filtered out, got %d events", len(events))
+	}
+
+	if count := countEphemeralRows(t, d, "as1"); count != 1 {
+		t.Fatalf("expected the expired row to still be present before sweeping, got %d", count)
+	}
+
+	if err := d.DeleteExpiredEphemeralEvents(ctx, "as1"); err != nil {
+		t.Fatalf("DeleteExpiredEphemeralEvents: %v", err)
+	}
+	if count := countEphemeralRows(t, d, "as1"); count != 0 {
+		t.Fatalf("expected DeleteExpiredEphemeralEvents to sweep the expired row, got %d remaining", count)
+	}
+}
+
+// TestCompleteTransactionOnlyDeletesDeliveredEphemeralEvents is a regression
+// test for the bug where CompleteTransaction deleted every ephemeral EDU
+// queued under a txn_id, including one folded into the same in-flight
+// transaction after it was selected for delivery but before the
+// application service acknowledged it.
+func TestCompleteTransactionOnlyDeletesDeliveredEphemeralEvents(t *testing.T) {
+	d := newTestDatabase(t)
+	ctx := context.Background()
+
+	if err := d.InsertEphemeralEvent(ctx, "as1", storage.EphemeralEvent{Type: "m.typing"}); err != nil {
+		t.Fatalf("InsertEphemeralEvent: %v", err)
+	}
+	batch, err := d.SelectEventsByApplicationServiceID(ctx, "as1", 0)
+	if err != nil {
+		t.Fatalf("SelectEventsByApplicationServiceID: %v", err)
+	}
+	_, maxEphemeralID, err := d.SelectEphemeralEventsByApplicationServiceID(ctx, "as1", batch.TxnID)
+	if err != nil {
+		t.Fatalf("SelectEphemeralEventsByApplicationServiceID: %v", err)
+	}
+
+	// Simulate an EDU arriving while the selected page above is in flight to
+	// the application service.
+	if err := d.InsertEphemeralEvent(ctx, "as1", storage.EphemeralEvent{Type: "m.presence"}); err != nil {
+		t.Fatalf("InsertEphemeralEvent: %v", err)
+	}
+
+	if err := d.CompleteTransaction(ctx, "as1", batch.TxnID, batch.MaxEventID, maxEphemeralID); err != nil {
+		t.Fatalf("CompleteTransaction: %v", err)
+	}
+
+	remaining, _, err := d.SelectEphemeralEventsByApplicationServiceID(ctx, "as1", batch.TxnID)
+	if err != nil {
+		t.Fatalf("SelectEphemeralEventsByApplicationServiceID: %v", err)
+	}
+	if len(remaining) != 1 || remaining[0].Type != "m.presence" {
+		t.Fatalf("expected the EDU inserted after selection to survive CompleteTransaction, got %+v", remaining)
+	}
+}
+
+func countEphemeralRows(t *testing.T, d *Database, appServiceID string) int {
+	t.Helper()
+	var count int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM appservice_ephemeral WHERE as_id = $1", appServiceID).Scan(&count); err != nil {
+		t.Fatalf("count query: %v", err)
+	}
+	return count
+}
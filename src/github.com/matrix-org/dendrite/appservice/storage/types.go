@@ -0,0 +1,55 @@
+// Copyright 2020 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import "github.com/matrix-org/gomatrixserverlib"
+
+// EphemeralEvent is an ephemeral EDU (typing, presence or a read receipt)
+// queued for delivery to an application service that opted in via MSC2409
+// (de.sorunome.msc2409.push_ephemeral / receive_ephemeral).
+type EphemeralEvent struct {
+	// Type is the EDU type, e.g. "m.typing" or "m.presence".
+	Type string `json:"type"`
+	// Content is the raw JSON content of the EDU.
+	Content gomatrixserverlib.RawJSON `json:"content"`
+	// RoomID is the room the EDU applies to, if any (typing and receipts
+	// are room-scoped, presence is not).
+	RoomID string `json:"room_id,omitempty"`
+}
+
+// Batch is the next unsent transaction queued for an application service: the
+// shared txn_id for the room events and ephemeral EDUs batched into it
+// (MSC2409 requires retries to reuse the same transaction ID), and the retry
+// bookkeeping needed to honour exponential backoff across restarts.
+type Batch struct {
+	// TxnID is the transaction ID to deliver this batch as, and to reuse on
+	// every retry.
+	TxnID int64
+	// MaxEventID is the highest internal appservice_events.id among the
+	// events actually delivered in Events, which may be fewer than every
+	// event queued into this transaction. It identifies exactly which rows
+	// to delete once this page is acknowledged, without relying on the
+	// lexicographic ordering of the (non-monotonic) Matrix event ID, and
+	// without deleting events the application service was never sent.
+	MaxEventID int64
+	EventIDs   []string
+	Events     []gomatrixserverlib.ApplicationServiceEvent
+	// AttemptCount is how many times delivery of this transaction has
+	// already failed.
+	AttemptCount int
+	// NextRetryAt is the unix time before which this transaction should not
+	// be retried, or zero if delivery has never been attempted.
+	NextRetryAt int64
+}
@@ -0,0 +1,221 @@
+// Copyright 2018 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// eventsPerTransaction is the maximum number of events batched into a single
+// transaction sent to an application service.
+const eventsPerTransaction = 50
+
+// initialBackoff and maxBackoff bound the exponential backoff applied
+// between retries of a transaction that an application service failed to
+// acknowledge. The attempt count driving it is persisted alongside the
+// transaction itself, so the backoff survives a worker restart instead of
+// resetting to initialBackoff.
+const (
+	initialBackoff = 2 * time.Second
+	maxBackoff     = 60 * time.Second
+)
+
+// stuckTransactionAttempts is how many failed delivery attempts a
+// transaction must accumulate before it is reported as stuck via the
+// dendrite_appservice_stuck_transactions metric.
+const stuckTransactionAttempts = 8
+
+// stuckTransactions reports, per application service, whether its
+// in-flight transaction has failed at least stuckTransactionAttempts times
+// without being acknowledged.
+var stuckTransactions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "dendrite",
+	Subsystem: "appservice",
+	Name:      "stuck_transactions",
+	Help:      "Whether an application service's in-flight transaction has exceeded the stuck-transaction retry threshold (1) or not (0).",
+}, []string{"as_id"})
+
+func init() {
+	prometheus.MustRegister(stuckTransactions)
+}
+
+// transaction is the body posted to an application service, as described by
+// the Application Service API. Ephemeral is only populated for application
+// services that opted into MSC2409 (de.sorunome.msc2409.push_ephemeral).
+type transaction struct {
+	Events    []gomatrixserverlib.ApplicationServiceEvent `json:"events"`
+	Ephemeral []storage.EphemeralEvent                    `json:"ephemeral,omitempty"`
+}
+
+// transactionPoster delivers a transaction to an application service and
+// reports whether it was accepted. It exists so that Worker can be tested
+// without a real HTTP round trip.
+type transactionPoster interface {
+	postTransaction(ctx context.Context, url string, txnID int64, body []byte) (ok bool, err error)
+}
+
+// httpTransactionPoster is the transactionPoster used in production: it PUTs
+// the transaction to the application service's configured URL, as Synapse
+// and the Application Service API spec require.
+type httpTransactionPoster struct {
+	client  *http.Client
+	hsToken string
+}
+
+func (p *httpTransactionPoster) postTransaction(ctx context.Context, url string, txnID int64, body []byte) (bool, error) {
+	req, err := http.NewRequest(
+		http.MethodPut,
+		fmt.Sprintf("%s/transactions/%d?access_token=%s", strings.TrimSuffix(url, "/"), txnID, p.hsToken),
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		// A network error is treated as a failed delivery attempt, not a
+		// fatal error, so the caller retries with backoff.
+		return false, nil
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 300, nil
+}
+
+// Worker pushes events queued for a single application service, retrying
+// with exponential backoff until the application service acknowledges
+// receipt, and only then removing the delivered events from storage. Retry
+// attempts and their backoff are persisted in storage rather than held in
+// memory, so a worker that restarts mid-backoff resumes waiting out the
+// same delay instead of hammering the application service again.
+type Worker struct {
+	db     storage.Database
+	poster transactionPoster
+	asID   string
+	url    string
+	sleep  func(time.Duration)
+	now    func() time.Time
+}
+
+// NewWorker creates a Worker that delivers events queued for the application
+// service identified by asID to url, authenticating with hsToken.
+func NewWorker(db storage.Database, asID, url, hsToken string) *Worker {
+	return &Worker{
+		db:     db,
+		poster: &httpTransactionPoster{client: http.DefaultClient, hsToken: hsToken},
+		asID:   asID,
+		url:    url,
+		sleep:  time.Sleep,
+		now:    time.Now,
+	}
+}
+
+// Run delivers queued events and ephemeral EDUs to the application service
+// in batches of up to eventsPerTransaction until no transaction is in
+// flight, blocking with exponential backoff between retries of an
+// unacknowledged transaction. A transaction with only ephemeral EDUs and no
+// room events (e.g. pure typing/presence traffic) is still delivered. It
+// returns when there is nothing left to deliver or a storage error is
+// encountered.
+func (w *Worker) Run(ctx context.Context) error {
+	for {
+		batch, err := w.db.SelectEventsByApplicationServiceID(ctx, w.asID, eventsPerTransaction)
+		if err != nil {
+			return err
+		}
+		if batch.TxnID == 0 {
+			return nil
+		}
+
+		if wait := time.Unix(batch.NextRetryAt, 0).Sub(w.now()); batch.NextRetryAt > 0 && wait > 0 {
+			w.sleep(wait)
+		}
+
+		ephemeral, maxEphemeralID, err := w.db.SelectEphemeralEventsByApplicationServiceID(ctx, w.asID, batch.TxnID)
+		if err != nil {
+			return err
+		}
+
+		body, err := json.Marshal(transaction{Events: batch.Events, Ephemeral: ephemeral})
+		if err != nil {
+			return err
+		}
+
+		ok, err := w.poster.postTransaction(ctx, w.url, batch.TxnID, body)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if err = w.markFailed(ctx, batch); err != nil {
+				return err
+			}
+			continue
+		}
+
+		stuckTransactions.WithLabelValues(w.asID).Set(0)
+		if err = w.db.CompleteTransaction(ctx, w.asID, batch.TxnID, batch.MaxEventID, maxEphemeralID); err != nil {
+			return err
+		}
+	}
+}
+
+// markFailed records a failed delivery attempt of batch, persisting the next
+// retry time so a restarted worker honours the same backoff, and surfaces
+// the transaction as stuck once it has failed stuckTransactionAttempts times.
+// It also sweeps ephemeral EDUs that went stale while this transaction was
+// retrying, so a transaction stuck against a down application service
+// doesn't grow appservice_ephemeral unbounded between restarts.
+func (w *Worker) markFailed(ctx context.Context, batch storage.Batch) error {
+	nextRetryAt := w.now().Add(backoffFor(batch.AttemptCount + 1)).Unix()
+	attemptCount, err := w.db.MarkTransactionFailed(ctx, w.asID, batch.TxnID, nextRetryAt)
+	if err != nil {
+		return err
+	}
+	if err = w.db.DeleteExpiredEphemeralEvents(ctx, w.asID); err != nil {
+		return err
+	}
+
+	stuck := 0.0
+	if attemptCount >= stuckTransactionAttempts {
+		stuck = 1.0
+	}
+	stuckTransactions.WithLabelValues(w.asID).Set(stuck)
+	return nil
+}
+
+// backoffFor returns the delay to wait before the attempt'th delivery
+// attempt, doubling from initialBackoff and capping at maxBackoff.
+func backoffFor(attempt int) time.Duration {
+	backoff := initialBackoff
+	for i := 1; i < attempt; i++ {
+		backoff *= 2
+		if backoff >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return backoff
+}
@@ -0,0 +1,261 @@
+// Copyright 2018 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/storage/mock"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fixedNow is the wall clock used by every test worker, so the backoff
+// windows they assert on don't depend on real elapsed time.
+var fixedNow = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// fakePoster is a transactionPoster whose responses are scripted per call.
+type fakePoster struct {
+	results []bool
+	calls   int
+}
+
+func (p *fakePoster) postTransaction(ctx context.Context, url string, txnID int64, body []byte) (bool, error) {
+	ok := p.results[p.calls]
+	p.calls++
+	return ok, nil
+}
+
+func newTestWorker(t *testing.T, db *mock.MockDatabase, poster transactionPoster) *Worker {
+	t.Helper()
+	return &Worker{
+		db:     db,
+		poster: poster,
+		asID:   "as1",
+		url:    "http://as.example.com",
+		sleep:  func(d time.Duration) {},
+		now:    func() time.Time { return fixedNow },
+	}
+}
+
+func TestWorkerRunBatchesAndDeletesAfterAck(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	db := mock.NewMockDatabase(ctrl)
+
+	batch := storage.Batch{
+		TxnID:      1,
+		MaxEventID: 2,
+		EventIDs:   []string{"$1", "$2"},
+		Events:     []gomatrixserverlib.ApplicationServiceEvent{{EventID: "$1"}, {EventID: "$2"}},
+	}
+
+	gomock.InOrder(
+		db.EXPECT().SelectEventsByApplicationServiceID(gomock.Any(), "as1", eventsPerTransaction).Return(batch, nil),
+		db.EXPECT().SelectEphemeralEventsByApplicationServiceID(gomock.Any(), "as1", int64(1)).Return(nil, int64(0), nil),
+		db.EXPECT().CompleteTransaction(gomock.Any(), "as1", int64(1), int64(2), int64(0)).Return(nil),
+		db.EXPECT().SelectEventsByApplicationServiceID(gomock.Any(), "as1", eventsPerTransaction).Return(storage.Batch{}, nil),
+	)
+
+	w := newTestWorker(t, db, &fakePoster{results: []bool{true}})
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("Run returned unexpected error: %v", err)
+	}
+}
+
+// TestWorkerRunCompletesOnlyDeliveredPage guards against regressing to
+// acknowledging more than was actually delivered: if more events are queued
+// into a transaction than fit in a single page, CompleteTransaction must be
+// called with the highest id among the delivered events, not the highest id
+// queued into the transaction overall.
+func TestWorkerRunCompletesOnlyDeliveredPage(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	db := mock.NewMockDatabase(ctrl)
+
+	// Three events are queued into the transaction, but only the first two
+	// fit in this page: MaxEventID must reflect that bound, not the third,
+	// undelivered event's id.
+	batch := storage.Batch{
+		TxnID:      1,
+		MaxEventID: 2,
+		EventIDs:   []string{"$1", "$2"},
+		Events:     []gomatrixserverlib.ApplicationServiceEvent{{EventID: "$1"}, {EventID: "$2"}},
+	}
+
+	gomock.InOrder(
+		db.EXPECT().SelectEventsByApplicationServiceID(gomock.Any(), "as1", eventsPerTransaction).Return(batch, nil),
+		db.EXPECT().SelectEphemeralEventsByApplicationServiceID(gomock.Any(), "as1", int64(1)).Return(nil, int64(0), nil),
+		db.EXPECT().CompleteTransaction(gomock.Any(), "as1", int64(1), int64(2), int64(0)).Return(nil),
+		db.EXPECT().SelectEventsByApplicationServiceID(gomock.Any(), "as1", eventsPerTransaction).Return(storage.Batch{}, nil),
+	)
+
+	w := newTestWorker(t, db, &fakePoster{results: []bool{true}})
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("Run returned unexpected error: %v", err)
+	}
+}
+
+// TestWorkerRunCompletesEphemeralOnlyUpToDeliveredID guards against the
+// ephemeral counterpart of the bug TestWorkerRunCompletesOnlyDeliveredPage
+// covers for room events: CompleteTransaction must bound its ephemeral
+// delete by the highest id actually selected for delivery, not delete every
+// EDU queued under the txn_id, so an EDU folded into the transaction during
+// the round-trip to the application service isn't silently discarded.
+func TestWorkerRunCompletesEphemeralOnlyUpToDeliveredID(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	db := mock.NewMockDatabase(ctrl)
+
+	batch := storage.Batch{
+		TxnID:      1,
+		MaxEventID: 2,
+		EventIDs:   []string{"$1", "$2"},
+		Events:     []gomatrixserverlib.ApplicationServiceEvent{{EventID: "$1"}, {EventID: "$2"}},
+	}
+	ephemeral := []storage.EphemeralEvent{{Type: "m.typing"}}
+
+	gomock.InOrder(
+		db.EXPECT().SelectEventsByApplicationServiceID(gomock.Any(), "as1", eventsPerTransaction).Return(batch, nil),
+		db.EXPECT().SelectEphemeralEventsByApplicationServiceID(gomock.Any(), "as1", int64(1)).Return(ephemeral, int64(5), nil),
+		db.EXPECT().CompleteTransaction(gomock.Any(), "as1", int64(1), int64(2), int64(5)).Return(nil),
+		db.EXPECT().SelectEventsByApplicationServiceID(gomock.Any(), "as1", eventsPerTransaction).Return(storage.Batch{}, nil),
+	)
+
+	w := newTestWorker(t, db, &fakePoster{results: []bool{true}})
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("Run returned unexpected error: %v", err)
+	}
+}
+
+func TestWorkerRunDeliversEphemeralOnlyTransaction(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	db := mock.NewMockDatabase(ctrl)
+
+	// A transaction can be open with only ephemeral EDUs queued (e.g. pure
+	// typing/presence traffic, with no room events at all).
+	batch := storage.Batch{TxnID: 1}
+	ephemeral := []storage.EphemeralEvent{{Type: "m.typing"}}
+
+	gomock.InOrder(
+		db.EXPECT().SelectEventsByApplicationServiceID(gomock.Any(), "as1", eventsPerTransaction).Return(batch, nil),
+		db.EXPECT().SelectEphemeralEventsByApplicationServiceID(gomock.Any(), "as1", int64(1)).Return(ephemeral, int64(9), nil),
+		db.EXPECT().CompleteTransaction(gomock.Any(), "as1", int64(1), int64(0), int64(9)).Return(nil),
+		db.EXPECT().SelectEventsByApplicationServiceID(gomock.Any(), "as1", eventsPerTransaction).Return(storage.Batch{}, nil),
+	)
+
+	w := newTestWorker(t, db, &fakePoster{results: []bool{true}})
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("Run returned unexpected error: %v", err)
+	}
+}
+
+func TestWorkerRunRetriesWithBackoffUntilAcked(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	db := mock.NewMockDatabase(ctrl)
+
+	firstAttempt := storage.Batch{
+		TxnID:      7,
+		MaxEventID: 1,
+		EventIDs:   []string{"$1"},
+		Events:     []gomatrixserverlib.ApplicationServiceEvent{{EventID: "$1"}},
+	}
+	secondAttempt := firstAttempt
+	secondAttempt.AttemptCount = 1
+	secondAttempt.NextRetryAt = fixedNow.Add(initialBackoff).Unix()
+	thirdAttempt := firstAttempt
+	thirdAttempt.AttemptCount = 2
+	thirdAttempt.NextRetryAt = fixedNow.Add(initialBackoff * 2).Unix()
+
+	gomock.InOrder(
+		db.EXPECT().SelectEventsByApplicationServiceID(gomock.Any(), "as1", eventsPerTransaction).Return(firstAttempt, nil),
+		db.EXPECT().SelectEphemeralEventsByApplicationServiceID(gomock.Any(), "as1", int64(7)).Return(nil, int64(0), nil),
+		db.EXPECT().MarkTransactionFailed(gomock.Any(), "as1", int64(7), fixedNow.Add(initialBackoff).Unix()).Return(1, nil),
+		db.EXPECT().DeleteExpiredEphemeralEvents(gomock.Any(), "as1").Return(nil),
+
+		db.EXPECT().SelectEventsByApplicationServiceID(gomock.Any(), "as1", eventsPerTransaction).Return(secondAttempt, nil),
+		db.EXPECT().SelectEphemeralEventsByApplicationServiceID(gomock.Any(), "as1", int64(7)).Return(nil, int64(0), nil),
+		db.EXPECT().MarkTransactionFailed(gomock.Any(), "as1", int64(7), fixedNow.Add(initialBackoff*2).Unix()).Return(2, nil),
+		db.EXPECT().DeleteExpiredEphemeralEvents(gomock.Any(), "as1").Return(nil),
+
+		db.EXPECT().SelectEventsByApplicationServiceID(gomock.Any(), "as1", eventsPerTransaction).Return(thirdAttempt, nil),
+		db.EXPECT().SelectEphemeralEventsByApplicationServiceID(gomock.Any(), "as1", int64(7)).Return(nil, int64(0), nil),
+		db.EXPECT().CompleteTransaction(gomock.Any(), "as1", int64(7), int64(1), int64(0)).Return(nil),
+
+		db.EXPECT().SelectEventsByApplicationServiceID(gomock.Any(), "as1", eventsPerTransaction).Return(storage.Batch{}, nil),
+	)
+
+	poster := &fakePoster{results: []bool{false, false, true}}
+	var slept []time.Duration
+	var sentTxnIDs []int64
+	w := &Worker{
+		db:     db,
+		poster: recordingPoster{poster, &sentTxnIDs},
+		asID:   "as1",
+		url:    "http://as.example.com",
+		sleep:  func(d time.Duration) { slept = append(slept, d) },
+		now:    func() time.Time { return fixedNow },
+	}
+
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("Run returned unexpected error: %v", err)
+	}
+	if poster.calls != 3 {
+		t.Fatalf("expected 3 delivery attempts, got %d", poster.calls)
+	}
+	// secondAttempt and thirdAttempt each carry a NextRetryAt in the future
+	// relative to fixedNow, so Run should have slept out each one before
+	// retrying.
+	if len(slept) != 2 || slept[0] != initialBackoff || slept[1] != initialBackoff*2 {
+		t.Fatalf("expected backoff to double across retries, got %v", slept)
+	}
+	for _, txnID := range sentTxnIDs {
+		if txnID != 7 {
+			t.Fatalf("expected every retry to reuse txn_id 7, got %v", sentTxnIDs)
+		}
+	}
+}
+
+// recordingPoster wraps a transactionPoster and records the txnID passed to
+// every delivery attempt, so tests can assert retries reuse the same ID.
+type recordingPoster struct {
+	transactionPoster
+	txnIDs *[]int64
+}
+
+func (p recordingPoster) postTransaction(ctx context.Context, url string, txnID int64, body []byte) (bool, error) {
+	*p.txnIDs = append(*p.txnIDs, txnID)
+	return p.transactionPoster.postTransaction(ctx, url, txnID, body)
+}
+
+func TestWorkerRunStopsOnStorageError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	db := mock.NewMockDatabase(ctrl)
+
+	wantErr := errors.New("db is on fire")
+	db.EXPECT().SelectEventsByApplicationServiceID(gomock.Any(), "as1", eventsPerTransaction).Return(storage.Batch{}, wantErr)
+
+	w := newTestWorker(t, db, &fakePoster{})
+	if err := w.Run(context.Background()); err != wantErr {
+		t.Fatalf("expected Run to surface storage error %v, got %v", wantErr, err)
+	}
+}
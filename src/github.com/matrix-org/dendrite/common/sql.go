@@ -17,12 +17,15 @@ package common
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 
 	"github.com/gchaincl/sqlhooks"
 	"github.com/gchaincl/sqlhooks/hooks/othooks"
 	"github.com/lib/pq"
 	"github.com/matrix-org/util"
+	"github.com/mattn/go-sqlite3"
 	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // A Transaction is something that can be committed or rolledback.
@@ -78,17 +81,81 @@ type NewTracerFactory interface {
 	CreateNewTracer(name string) opentracing.Tracer
 }
 
-// OpenPostgresWithTracing creates a new DB instance where calls will be
-// traced with the given tracer
-func OpenPostgresWithTracing(tracerFactory NewTracerFactory, databaseName, connstr string) (*sql.DB, error) {
-	tracer := tracerFactory.CreateNewTracer("sql - " + databaseName)
-
-	hooks := othooks.New(tracer)
-
-	// This is a hack to get around the fact that you can't directly open
-	// a sql.DB with a given driver, you *have* to register it.
+// openPostgres registers and opens a Postgres connection wrapped with the
+// given sqlhooks.Hooks. This is a hack to get around the fact that you
+// can't directly open a sql.DB with a given driver, you *have* to register
+// it.
+func openPostgres(hooks sqlhooks.Hooks, connstr string) (*sql.DB, error) {
 	registrationName := fmt.Sprintf("postgres-ot-%s", util.RandomString(5))
 	sql.Register(registrationName, sqlhooks.Wrap(&pq.Driver{}, hooks))
-
 	return sql.Open(registrationName, connstr)
 }
+
+// sqliteBusyTimeout is how long a SQLite connection will wait on a
+// SQLITE_BUSY lock held by another connection before giving up, via the
+// go-sqlite3 driver's _busy_timeout DSN option. go-sqlite3 has no built-in
+// retry of its own, so without this, a writer racing another connection's
+// transaction (e.g. a worker's CompleteTransaction racing an InsertEvent)
+// would surface "database is locked" immediately instead of just waiting
+// out the other side's commit.
+const sqliteBusyTimeout = "5000"
+
+// openSQLite registers and opens a SQLite connection wrapped with the given
+// sqlhooks.Hooks, with a busy timeout so a connection waits out a
+// SQLITE_BUSY lock held by another connection rather than erroring
+// immediately (go-sqlite3 has no built-in retry of its own). Callers for
+// whom SQLite's single-writer restriction matters (i.e. anything that
+// writes, rather than only reads) should additionally call
+// db.SetMaxOpenConns(1) on the returned *sql.DB themselves: capping it here
+// would serialise every caller's reads as well as its writes, which only
+// some callers want.
+func openSQLite(hooks sqlhooks.Hooks, dataSourceName string) (*sql.DB, error) {
+	registrationName := fmt.Sprintf("sqlite3-ot-%s", util.RandomString(5))
+	sql.Register(registrationName, sqlhooks.Wrap(&sqlite3.SQLiteDriver{}, hooks))
+
+	dsn := strings.TrimPrefix(dataSourceName, "file:")
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return sql.Open(registrationName, dsn+sep+"_busy_timeout="+sqliteBusyTimeout)
+}
+
+// DriverName identifies which SQL driver backs a database connection opened
+// by OpenWithObservability.
+type DriverName string
+
+// The drivers that OpenWithObservability knows how to pick between.
+const (
+	DriverPostgres DriverName = "postgres"
+	DriverSQLite   DriverName = "sqlite3"
+)
+
+// OpenWithObservability opens a database connection where calls are traced
+// with the given tracer, choosing the driver from the scheme of
+// dataSourceName: a "postgres://" or "postgresql://" URI selects Postgres,
+// anything else (a bare file path or a "file:" URI) selects SQLite. This
+// lets callers accept a single connection string from config and remain
+// agnostic to which database backs them. It additionally installs a
+// Prometheus metrics hook alongside the opentracing one. The
+// metrics hook records query latency histograms, error counters and
+// in-flight query gauges, labelled by databaseName and a caller-provided
+// statement label attached to the query's context with WithStatementLabel
+// (queries with no label attached are reported under "unknown"). Pass the
+// registerer to register against, e.g. prometheus.DefaultRegisterer.
+func OpenWithObservability(
+	tracerFactory NewTracerFactory,
+	registerer prometheus.Registerer,
+	databaseName, dataSourceName string,
+) (*sql.DB, DriverName, error) {
+	tracer := tracerFactory.CreateNewTracer("sql - " + databaseName)
+	hooks := multiHooks{othooks.New(tracer), newMetricsHooks(registerer, databaseName)}
+
+	if strings.HasPrefix(dataSourceName, "postgres://") || strings.HasPrefix(dataSourceName, "postgresql://") {
+		db, err := openPostgres(hooks, dataSourceName)
+		return db, DriverPostgres, err
+	}
+
+	db, err := openSQLite(hooks, dataSourceName)
+	return db, DriverSQLite, err
+}
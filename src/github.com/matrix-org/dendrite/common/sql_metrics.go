@@ -0,0 +1,156 @@
+// Copyright 2020 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"time"
+
+	"github.com/gchaincl/sqlhooks"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// unlabelledStatement is used when a query runs without a statement label
+// attached to its context via WithStatementLabel.
+const unlabelledStatement = "unknown"
+
+type statementLabelContextKey struct{}
+type queryStartContextKey struct{}
+
+// WithStatementLabel attaches label (e.g. "selectEventsByApplicationServiceID")
+// to ctx so that a metrics hook installed by OpenWithObservability tags its
+// histograms and counters with it, rather than lumping every query for a
+// database together under one series.
+func WithStatementLabel(ctx context.Context, label string) context.Context {
+	return context.WithValue(ctx, statementLabelContextKey{}, label)
+}
+
+func statementLabelFromContext(ctx context.Context) string {
+	if label, ok := ctx.Value(statementLabelContextKey{}).(string); ok {
+		return label
+	}
+	return unlabelledStatement
+}
+
+// metricsHooks is a sqlhooks.Hooks that records Prometheus metrics for every
+// query it sees: a latency histogram, an error counter and an in-flight
+// gauge, each labelled by database name and statement label.
+type metricsHooks struct {
+	databaseName    string
+	queryDuration   *prometheus.HistogramVec
+	queryErrors     *prometheus.CounterVec
+	queriesInFlight *prometheus.GaugeVec
+}
+
+// newMetricsHooks creates and registers the collectors backing a
+// metricsHooks against registerer. Each call creates its own collectors, so
+// registerer must be able to tolerate being handed the same metric names
+// more than once if multiple databases are opened (e.g. by giving each a
+// distinct registry, or relying on MustRegister panicking loudly if not).
+func newMetricsHooks(registerer prometheus.Registerer, databaseName string) *metricsHooks {
+	h := &metricsHooks{
+		databaseName: databaseName,
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "dendrite",
+			Subsystem: "sql",
+			Name:      "query_duration_seconds",
+			Help:      "Time taken by SQL queries, by database and statement.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"database", "statement"}),
+		queryErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "sql",
+			Name:      "query_errors_total",
+			Help:      "Number of SQL queries that returned an error, by database and statement.",
+		}, []string{"database", "statement"}),
+		queriesInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "sql",
+			Name:      "queries_in_flight",
+			Help:      "Number of SQL queries currently executing, by database and statement.",
+		}, []string{"database", "statement"}),
+	}
+	registerer.MustRegister(h.queryDuration, h.queryErrors, h.queriesInFlight)
+	return h
+}
+
+// Before implements sqlhooks.Hooks.
+func (h *metricsHooks) Before(ctx context.Context, query string, args ...interface{}) (context.Context, error) {
+	label := statementLabelFromContext(ctx)
+	h.queriesInFlight.WithLabelValues(h.databaseName, label).Inc()
+	return context.WithValue(ctx, queryStartContextKey{}, time.Now()), nil
+}
+
+// After implements sqlhooks.Hooks.
+func (h *metricsHooks) After(ctx context.Context, query string, args ...interface{}) (context.Context, error) {
+	h.observe(ctx)
+	return ctx, nil
+}
+
+// OnError implements sqlhooks.OnErrorer, recording the error against
+// queryErrors in addition to the latency and in-flight bookkeeping that
+// After would otherwise have done.
+func (h *metricsHooks) OnError(ctx context.Context, err error, query string, args ...interface{}) error {
+	h.queryErrors.WithLabelValues(h.databaseName, statementLabelFromContext(ctx)).Inc()
+	h.observe(ctx)
+	return err
+}
+
+func (h *metricsHooks) observe(ctx context.Context) {
+	label := statementLabelFromContext(ctx)
+	h.queriesInFlight.WithLabelValues(h.databaseName, label).Dec()
+	if start, ok := ctx.Value(queryStartContextKey{}).(time.Time); ok {
+		h.queryDuration.WithLabelValues(h.databaseName, label).Observe(time.Since(start).Seconds())
+	}
+}
+
+// onErrorer is the optional sqlhooks interface for hooks that want to
+// observe query errors; othooks.New doesn't implement it, metricsHooks does.
+type onErrorer interface {
+	OnError(ctx context.Context, err error, query string, args ...interface{}) error
+}
+
+// multiHooks fans a single sqlhooks callback out to several Hooks, so a
+// connection can be both traced and measured at once.
+type multiHooks []sqlhooks.Hooks
+
+func (m multiHooks) Before(ctx context.Context, query string, args ...interface{}) (context.Context, error) {
+	var err error
+	for _, h := range m {
+		if ctx, err = h.Before(ctx, query, args...); err != nil {
+			return ctx, err
+		}
+	}
+	return ctx, nil
+}
+
+func (m multiHooks) After(ctx context.Context, query string, args ...interface{}) (context.Context, error) {
+	var err error
+	for _, h := range m {
+		if ctx, err = h.After(ctx, query, args...); err != nil {
+			return ctx, err
+		}
+	}
+	return ctx, nil
+}
+
+func (m multiHooks) OnError(ctx context.Context, err error, query string, args ...interface{}) error {
+	for _, h := range m {
+		if oe, ok := h.(onErrorer); ok {
+			err = oe.OnError(ctx, err, query, args...)
+		}
+	}
+	return err
+}